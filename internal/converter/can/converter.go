@@ -15,38 +15,334 @@
 package can
 
 import (
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/ngjaying/can"
 	"github.com/ngjaying/can/pkg/descriptor"
-	"github.com/ngjaying/can/pkg/generate"
 	"github.com/valyala/fastjson"
-	"os"
-	"path/filepath"
-	"strings"
+	"runtime"
+	"sort"
 
 	"github.com/lf-edge/ekuiper/internal/conf"
 	"github.com/lf-edge/ekuiper/pkg/message"
 )
 
-// The converter for socketCan format
-// Expect to receive a socketCan bytes array [16]byte with canId and data inside
+// The converter decodes CAN signals described by DBC files. By default it
+// expects the {"meta":...,"frames":[...]} JSON envelope; pass
+// Option{Format: FormatSocketCAN} to decode raw Linux SocketCAN
+// struct can_frame / struct canfd_frame bytes instead.
 
 type packedFrames struct {
 	Meta   map[string]interface{} `json:"meta,omitempty"`
 	Frames []can.Frame            `json:"frames,omitempty"`
 }
 
+// outFrame is the wire representation of a single encoded can.Frame. can.Frame
+// itself carries no json tags (Decode builds it field by field), so Encode
+// marshals through this local mirror instead.
+type outFrame struct {
+	ID   uint32 `json:"id"`
+	Data string `json:"data"`
+}
+
+type outPackedFrames struct {
+	Meta   map[string]interface{} `json:"meta,omitempty"`
+	Frames []outFrame             `json:"frames"`
+}
+
+// Linux SocketCAN can_id flag bits and masks, see linux/can.h.
+const (
+	canEFFFlag uint32 = 0x80000000 // frame uses the 29-bit extended id
+	canEFFMask uint32 = 0x1FFFFFFF
+	canSFFMask uint32 = 0x000007FF
+
+	canFrameLen   = 16 // sizeof(struct can_frame)
+	canFDFrameLen = 72 // sizeof(struct canfd_frame)
+	// timestampLen is the width of the little-endian unix-microsecond
+	// timestamp the batched decoder expects ahead of every frame record.
+	timestampLen = 8
+)
+
+// Format selects how Converter.Decode interprets the bytes it is given.
+type Format string
+
+const (
+	// FormatJSON is the default {"meta":...,"frames":[...]} envelope.
+	FormatJSON Format = "json"
+	// FormatSocketCAN decodes raw Linux SocketCAN struct can_frame /
+	// struct canfd_frame bytes instead of JSON.
+	FormatSocketCAN Format = "socketcan"
+)
+
+// Option configures the binary decoding mode of a Converter. The zero value
+// keeps the original JSON envelope behavior.
+type Option struct {
+	// Format selects the wire format Decode expects. Defaults to FormatJSON.
+	Format Format
+	// FD decodes struct canfd_frame (72 bytes, DLC up to 64) instead of the
+	// classic 16-byte struct can_frame. Only meaningful when Format is
+	// FormatSocketCAN.
+	FD bool
+	// Batch treats the buffer passed to Decode as a sequence of concatenated,
+	// timestamp-prefixed frame records (8-byte little-endian unix-microsecond
+	// timestamp followed by a can_frame/canfd_frame; not the candump -L ASCII
+	// text format) instead of a single frame. Only meaningful when Format is
+	// FormatSocketCAN.
+	Batch bool
+	// IsoTP, when set, reassembles ISO-TP (ISO 15765-2) single/first/
+	// consecutive frames into complete payloads before they are matched
+	// against the loaded DBC messages, so messages spanning more than 8
+	// bytes (UDS, OBD-II extended PIDs, J1939 TP) decode correctly.
+	IsoTP *IsoTPConfig
+	// Bus is the default bus/channel namespace this converter decodes
+	// against, matching a DBC catalog loaded from a per-bus subdirectory
+	// (see DBCCatalog). A JSON envelope's "meta.bus" overrides it per call;
+	// binary modes always use it since they carry no meta. Defaults to "".
+	Bus string
+}
+
 type Converter struct {
-	messages map[uint32]*descriptor.Message
+	catalog *DBCCatalog
+	format  Format
+	fd      bool
+	batch   bool
+	isotp   *isoTPReassembler
+	bus     string
+}
+
+// Encode packs a map of DBC signal name -> value into one or more CAN frames
+// and renders them in the same JSON envelope Decode accepts, i.e.
+// {"meta":{...},"frames":[{"id":<uint>,"data":"<hex>"}]}. Signals are grouped
+// back to their owning message by looking them up against the catalog
+// snapshot for c.bus, so a single call can produce several frames if the
+// given data spans multiple messages. A signal that a message declares but
+// that is absent from data is zero-filled rather than rejected.
+func (c *Converter) Encode(d interface{}) ([]byte, error) {
+	data, meta, err := toSignalMap(d)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := c.catalog.snapshot.Load()
+	if snapshot == nil {
+		return nil, fmt.Errorf("cannot encode `%v`: no dbc messages loaded", data)
+	}
+	touched := make(map[uint32]*descriptor.Message)
+	for key, m := range *snapshot {
+		if key.bus != c.bus {
+			continue
+		}
+		for _, sig := range m.Signals {
+			if _, ok := data[sig.Name]; ok {
+				touched[key.id] = m
+				break
+			}
+		}
+	}
+	if len(touched) == 0 {
+		return nil, fmt.Errorf("cannot encode `%v`: no signal matches any loaded dbc message", data)
+	}
+
+	ids := make([]uint32, 0, len(touched))
+	for id := range touched {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	result := &outPackedFrames{Meta: meta}
+	for _, id := range ids {
+		m := touched[id]
+		// zero-fill signals the message declares but that are missing from data
+		msgData := make(map[string]interface{}, len(m.Signals))
+		for _, sig := range m.Signals {
+			if v, ok := data[sig.Name]; ok {
+				msgData[sig.Name] = v
+			} else {
+				msgData[sig.Name] = float64(0)
+			}
+		}
+		frame := &can.Frame{ID: id}
+		for _, sig := range m.Signals {
+			fv, ok := msgData[sig.Name].(float64)
+			if !ok {
+				return nil, fmt.Errorf("cannot encode message %s(%d): signal %s value %v is not numeric", m.Name, id, sig.Name, msgData[sig.Name])
+			}
+			raw := sig.FromPhysical(fv)
+			switch {
+			case sig.Length == 1:
+				sig.MarshalBool(&frame.Data, raw != 0)
+			case sig.IsSigned:
+				sig.MarshalSigned(&frame.Data, int64(raw))
+			default:
+				sig.MarshalUnsigned(&frame.Data, uint64(raw))
+			}
+		}
+		result.Frames = append(result.Frames, outFrame{ID: frame.ID, Data: hex.EncodeToString(frame.Data[:])})
+	}
+	return json.Marshal(result)
 }
 
-func (c *Converter) Encode(_ interface{}) ([]byte, error) {
-	//TODO implement me
-	panic("implement me")
+// toSignalMap normalizes the accepted Encode input into a flat signal
+// name -> value map, pulling out the reserved "meta" key (if any) along the
+// way.
+func toSignalMap(d interface{}) (map[string]interface{}, map[string]interface{}, error) {
+	v, ok := d.(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported type %T, must be a map[string]interface{}", d)
+	}
+	data := make(map[string]interface{}, len(v))
+	var meta map[string]interface{}
+	for k, val := range v {
+		if k == "meta" {
+			if m, ok := val.(map[string]interface{}); ok {
+				meta = m
+			}
+			continue
+		}
+		data[k] = val
+	}
+	return data, meta, nil
 }
 
 func (c *Converter) Decode(b []byte) (interface{}, error) {
+	if c.format == FormatSocketCAN {
+		if c.batch {
+			return c.decodeSocketCANBatch(b)
+		}
+		return c.decodeSocketCANFrame(b)
+	}
+	return c.decodeJSON(b)
+}
+
+// decodeSocketCANFrame parses a single raw struct can_frame (16 bytes) or, in
+// FD mode, struct canfd_frame (72 bytes) and feeds it into the existing DBC
+// decode path.
+func (c *Converter) decodeSocketCANFrame(b []byte) (interface{}, error) {
+	id, payload, err := parseSocketCANFrame(b, c.fd)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]interface{})
+	c.decodeFrameInto(c.bus, id, payload, result)
+	return result, nil
+}
+
+// decodeSocketCANBatch walks a buffer of concatenated, timestamp-prefixed
+// frame records (8-byte little-endian unix-microsecond timestamp followed by
+// a can_frame/canfd_frame), merging every frame's signals into one result map
+// and collecting the per-frame timestamps into a sibling top-level
+// meta["timestamps"] entry, the same flat shape decodeJSON and
+// decodeSocketCANFrame return so a consumer reading a signal field does not
+// need to know which Option combination produced the result.
+func (c *Converter) decodeSocketCANBatch(b []byte) (interface{}, error) {
+	frameLen := canFrameLen
+	if c.fd {
+		frameLen = canFDFrameLen
+	}
+	recordLen := timestampLen + frameLen
+	if len(b) == 0 || len(b)%recordLen != 0 {
+		return nil, fmt.Errorf("invalid batched socketcan buffer of %d bytes, expect a multiple of %d", len(b), recordLen)
+	}
+
+	result := make(map[string]interface{})
+	timestamps := make([]int64, 0, len(b)/recordLen)
+	for offset := 0; offset < len(b); offset += recordLen {
+		ts := int64(binary.LittleEndian.Uint64(b[offset : offset+timestampLen]))
+		id, payload, err := parseSocketCANFrame(b[offset+timestampLen:offset+recordLen], c.fd)
+		if err != nil {
+			return nil, err
+		}
+		c.decodeFrameInto(c.bus, id, payload, result)
+		timestamps = append(timestamps, ts)
+	}
+	result["meta"] = map[string]interface{}{"timestamps": timestamps}
+	return result, nil
+}
+
+// decodeFrameInto looks up id against the loaded DBC messages and, if found,
+// decodes payload's signals into result. Unknown ids are logged and skipped,
+// matching decodeJSON's behavior. payload is exactly the declared dlc bytes
+// for a SocketCAN frame, which for an FD frame can exceed 8, and the full
+// 8-byte data of a JSON envelope frame; it is threaded straight
+// through (rather than via can.Frame, whose Data is fixed at 8 bytes) so
+// signals defined past byte 8 still decode instead of being truncated away.
+func (c *Converter) decodeFrameInto(bus string, id uint32, payload []byte, result map[string]interface{}) {
+	if c.isotp != nil {
+		reassembled, err := c.isotp.feed(bus, id, payload)
+		if err != nil {
+			conf.Log.Errorf("ISO-TP reassembly for message %d failed: %v", id, err)
+			return
+		}
+		if reassembled == nil {
+			// frame consumed into an in-flight session (or was an inbound
+			// flow-control frame); nothing to decode yet
+			return
+		}
+		c.decodePayloadInto(bus, id, reassembled, result)
+		return
+	}
+	c.decodePayloadInto(bus, id, payload, result)
+}
+
+// decodePayloadInto looks up (bus, id) against the catalog snapshot and
+// decodes payload's signals into result. payload longer than 8 bytes (e.g. an
+// ISO-TP-reassembled UDS/OBD-II/J1939-TP message) bypasses can.Frame, whose
+// Data is fixed at 8 bytes, and is decoded directly from the byte slice via
+// desc.Decode, which (unlike DecodeToMap) takes a can.Payload and so isn't
+// bound by that 8-byte limit. Unknown (bus, id) pairs are logged and skipped,
+// matching the previous single-bus behavior.
+func (c *Converter) decodePayloadInto(bus string, id uint32, payload []byte, result map[string]interface{}) {
+	desc, ok := c.catalog.Lookup(bus, id)
+	if !ok {
+		conf.Log.Errorf("cannot find message %d on bus %q", id, bus)
+		return
+	}
+	if len(payload) <= 8 {
+		frame := &can.Frame{ID: id}
+		copy(frame.Data[:], payload)
+		desc.DecodeToMap(frame, result)
+		return
+	}
+	for _, s := range desc.Decode(&can.Payload{Data: payload}) {
+		result[s.Signal.Name] = s.Value
+	}
+}
+
+// parseSocketCANFrame extracts the CAN id and data payload from a raw struct
+// can_frame (16 bytes) or, when fd is true, struct canfd_frame (72 bytes). The
+// 29/11-bit id is unmasked according to the EFF flag. The returned payload is
+// exactly dlc bytes, which for an FD frame can be up to 64 -- longer than
+// can.Frame.Data's fixed 8 bytes -- so callers must decode it directly (see
+// decodePayloadInto's >8-byte bypass) rather than copying it into a can.Frame,
+// or signals defined past byte 8 would silently come back zero.
+func parseSocketCANFrame(b []byte, fd bool) (uint32, []byte, error) {
+	want := canFrameLen
+	if fd {
+		want = canFDFrameLen
+	}
+	if len(b) != want {
+		return 0, nil, fmt.Errorf("invalid socketcan frame of %d bytes, expect %d", len(b), want)
+	}
+	rawID := binary.LittleEndian.Uint32(b[0:4])
+	var id uint32
+	if rawID&canEFFFlag != 0 {
+		id = rawID & canEFFMask
+	} else {
+		id = rawID & canSFFMask
+	}
+	dlc := int(b[4])
+	data := b[8:]
+	if dlc > len(data) {
+		return 0, nil, fmt.Errorf("socketcan frame declares dlc %d beyond its %d byte payload", dlc, len(data))
+	}
+	payload := make([]byte, dlc)
+	copy(payload, data[:dlc])
+	return id, payload, nil
+}
+
+func (c *Converter) decodeJSON(b []byte) (interface{}, error) {
 	var p fastjson.Parser
 	v, err := p.ParseBytes(b)
 	if err != nil {
@@ -61,13 +357,21 @@ func (c *Converter) Decode(b []byte) (interface{}, error) {
 	pf := &packedFrames{}
 
 	// decode frames
-	rawFrames, err := obj.Get("frames").Array()
+	framesVal := obj.Get("frames")
+	if framesVal == nil {
+		return nil, fmt.Errorf("invalid frame json `%s`, no frames", b)
+	}
+	rawFrames, err := framesVal.Array()
 	if err != nil {
 		return nil, fmt.Errorf("invalid frame json `%s`, should have frames array but receive error: %v", b, err)
 	}
 	pf.Frames = make([]can.Frame, len(rawFrames))
 	for i, rawFrame := range rawFrames {
-		tid, err := rawFrame.Get("id").Uint()
+		idVal := rawFrame.Get("id")
+		if idVal == nil {
+			return nil, fmt.Errorf("invalid frame json `%s`, frame missing id", b)
+		}
+		tid, err := idVal.Uint()
 		if err != nil {
 			return nil, fmt.Errorf("invalid frame json `%s`, frame id should be uint but receive error: %v", b, err)
 		}
@@ -88,9 +392,12 @@ func (c *Converter) Decode(b []byte) (interface{}, error) {
 	}
 
 	// decode meta
-	metaObj, err := obj.Get("meta").Object()
-	if err != nil {
-		return nil, fmt.Errorf("invalid frame json `%s`, should have meta object but receive error: %v", b, err)
+	var metaObj *fastjson.Object
+	if metaVal := obj.Get("meta"); metaVal != nil {
+		metaObj, err = metaVal.Object()
+		if err != nil {
+			return nil, fmt.Errorf("invalid frame json `%s`, should have meta object but receive error: %v", b, err)
+		}
 	}
 	if metaObj != nil {
 		pf.Meta = make(map[string]interface{})
@@ -110,80 +417,61 @@ func (c *Converter) Decode(b []byte) (interface{}, error) {
 		})
 	}
 
+	bus := c.bus
+	// read meta.bus from the parsed value: pf.Meta keeps fastjson's quoted
+	// rendering of string values, which would never match a catalog bus
+	if busVal := v.Get("meta", "bus"); busVal != nil && busVal.Type() == fastjson.TypeString {
+		bus = string(busVal.GetStringBytes())
+	}
 	result := make(map[string]interface{})
-	for _, frame := range pf.Frames {
-		desc, ok := c.messages[frame.ID]
-		if !ok {
-			conf.Log.Errorf("cannot find message %d", frame.ID)
-			continue
-		}
-		desc.DecodeToMap(&frame, result)
+	for i := range pf.Frames {
+		frame := &pf.Frames[i]
+		c.decodeFrameInto(bus, frame.ID, frame.Data[:], result)
 	}
 	return result, nil
 }
 
-func NewConverter(dbcPath string) (message.Converter, error) {
-	dir, err := os.Stat(dbcPath)
+// NewConverter loads every DBC file under dbcPath (or dbcPath itself if it is
+// a single file) into a DBCCatalog and returns a Converter decoding the JSON
+// envelope by default. When dbcPath is a directory, the catalog keeps
+// watching it for changes so it can be refreshed without restarting eKuiper;
+// a single file is loaded once and not watched. Pass an Option to switch to
+// raw SocketCAN frames, namespace by bus, or enable ISO-TP reassembly, e.g.
+// NewConverter(path, Option{Format: FormatSocketCAN, Bus: "can0"}).
+func NewConverter(dbcPath string, opts ...Option) (message.Converter, error) {
+	catalog, err := NewDBCCatalog(dbcPath)
 	if err != nil {
 		return nil, err
 	}
-	mm := make(map[uint32]*descriptor.Message)
-	if dir.IsDir() {
-		var (
-			files []string
-			max   int64
-		)
-		err = filepath.Walk(dbcPath, func(path string, info os.FileInfo, err error) error {
-			if strings.EqualFold(filepath.Ext(path), ".dbc") {
-				if info.Size() > max {
-					max = info.Size()
-				}
-				files = append(files, path)
-			}
-			return nil
-		})
-		if err != nil {
-			return nil, err
-		}
-		b1 := make([]byte, max)
-		for _, file := range files {
-			f, err := os.Open(file)
-			if err != nil {
-				return nil, err
-			}
-			n, err := f.Read(b1)
-			if err != nil {
-				return nil, err
-			}
-			err = addMessageDb(mm, file, b1[:n])
-			if err != nil {
-				return nil, err
-			}
+	c := &Converter{
+		catalog: catalog,
+		format:  FormatJSON,
+	}
+	if len(opts) > 0 {
+		opt := opts[0]
+		if opt.Format != "" {
+			c.format = opt.Format
 		}
-	} else {
-		dbc, err := os.ReadFile(dbcPath)
-		if nil != err {
-			return nil, err
-		}
-		err = addMessageDb(mm, dbcPath, dbc)
-		if err != nil {
-			return nil, err
+		c.fd = opt.FD
+		c.batch = opt.Batch
+		c.bus = opt.Bus
+		if opt.IsoTP != nil {
+			c.isotp = newIsoTPReassembler(*opt.IsoTP)
 		}
 	}
-	return &Converter{
-		messages: mm,
-	}, nil
+	// message.Converter, the interface NewConverter returns, does not expose
+	// Close, so a caller holding only that interface has no way to stop the
+	// catalog's background watcher goroutine. Fall back to a finalizer so the
+	// watcher and its fsnotify handle are still reclaimed once the Converter
+	// is garbage collected, instead of leaking for the life of the process.
+	runtime.SetFinalizer(c, func(c *Converter) { _ = c.Close() })
+	return c, nil
 }
 
-func addMessageDb(mm map[uint32]*descriptor.Message, dbcPath string, dbcContent []byte) error {
-	c, err := generate.Compile(dbcPath, dbcContent)
-	if err != nil {
-		return err
-	}
-	for _, m := range c.Database.Messages {
-		if _, ok := mm[m.ID]; !ok {
-			mm[m.ID] = m
-		}
-	}
-	return nil
+// Close stops the underlying catalog's directory watcher, if any. Callers
+// that do obtain a concrete *Converter (e.g. via a type assertion) should
+// still call Close explicitly for prompt cleanup rather than relying on the
+// finalizer, which only runs when the garbage collector gets around to it.
+func (c *Converter) Close() error {
+	return c.catalog.Close()
 }
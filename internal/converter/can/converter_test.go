@@ -0,0 +1,244 @@
+// Copyright 2023 EMQ Technologies Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package can
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testDbc declares four messages so round-trip tests exercise both signal
+// byte orders and a signed value:
+//   - LITTLE_MSG (id 100): Intel (little-endian) byte order, unsigned
+//   - BIG_MSG (id 200): Motorola (big-endian) byte order, signed
+//   - FD_MSG (id 300): a 16-byte CAN FD message with a signal past byte 8
+//   - PAIR_MSG (id 400): two signals, for zero-filling an absent one
+const testDbc = `VERSION ""
+
+NS_ :
+
+BS_:
+
+BU_: ECU
+
+BO_ 100 LITTLE_MSG: 8 ECU
+ SG_ Speed : 0|16@1+ (0.1,0) [0|6553.5] "km/h" ECU
+
+BO_ 200 BIG_MSG: 8 ECU
+ SG_ Temp : 7|16@0- (0.1,-40) [-40|150] "C" ECU
+
+BO_ 300 FD_MSG: 16 ECU
+ SG_ FdSignal : 64|16@1+ (1,0) [0|65535] "" ECU
+
+BO_ 400 PAIR_MSG: 8 ECU
+ SG_ Rpm : 0|16@1+ (1,0) [0|65535] "" ECU
+ SG_ Gear : 16|8@1+ (1,0) [0|255] "" ECU
+`
+
+func newTestConverter(t *testing.T, opts ...Option) *Converter {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.dbc")
+	if err := os.WriteFile(path, []byte(testDbc), 0o644); err != nil {
+		t.Fatalf("cannot write test dbc: %v", err)
+	}
+	conv, err := NewConverter(path, opts...)
+	if err != nil {
+		t.Fatalf("cannot load test dbc: %v", err)
+	}
+	return conv.(*Converter)
+}
+
+// buildCanFrame renders a raw 16-byte struct can_frame carrying a standard
+// (11-bit) id and up to 8 data bytes.
+func buildCanFrame(id uint32, data []byte) []byte {
+	b := make([]byte, canFrameLen)
+	binary.LittleEndian.PutUint32(b[0:4], id)
+	b[4] = byte(len(data))
+	copy(b[8:], data)
+	return b
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		data map[string]interface{}
+	}{
+		{
+			name: "little endian unsigned",
+			data: map[string]interface{}{"Speed": 12.3},
+		},
+		{
+			name: "big endian signed negative",
+			data: map[string]interface{}{"Temp": -12.5},
+		},
+		{
+			name: "multiple messages in one publish",
+			data: map[string]interface{}{"Speed": 40.0, "Temp": 21.0},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestConverter(t)
+			encoded, err := c.Encode(tc.data)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			decoded, err := c.Decode(encoded)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			got, ok := decoded.(map[string]interface{})
+			if !ok {
+				t.Fatalf("decode result has unexpected type %T", decoded)
+			}
+			if !reflect.DeepEqual(got, tc.data) {
+				t.Errorf("round trip mismatch: sent %v, got back %v", tc.data, got)
+			}
+		})
+	}
+}
+
+func TestEncodeMissingOptionalSignalZeroFilled(t *testing.T) {
+	c := newTestConverter(t)
+	// only Rpm is supplied; PAIR_MSG's other signal, Gear, is absent from the
+	// input and must come back zero-filled.
+	encoded, err := c.Encode(map[string]interface{}{"Rpm": 5.0})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	decoded, err := c.Decode(encoded)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	got := decoded.(map[string]interface{})
+	if got["Rpm"] != 5.0 {
+		t.Errorf("expected Rpm 5.0, got %v", got["Rpm"])
+	}
+	if got["Gear"] != 0.0 {
+		t.Errorf("expected zero-filled Gear 0, got %v", got["Gear"])
+	}
+}
+
+func TestEncodeWithMeta(t *testing.T) {
+	c := newTestConverter(t)
+	encoded, err := c.Encode(map[string]interface{}{
+		"Speed": 1.0,
+		"meta":  map[string]interface{}{"source": "bench"},
+	})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if !strings.Contains(string(encoded), `"meta"`) {
+		t.Errorf("expected encoded json to contain meta, got %s", encoded)
+	}
+}
+
+func TestEncodeWithoutMetaOmitsKey(t *testing.T) {
+	c := newTestConverter(t)
+	encoded, err := c.Encode(map[string]interface{}{"Speed": 1.0})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if strings.Contains(string(encoded), `"meta"`) {
+		t.Errorf("expected encoded json to omit meta, got %s", encoded)
+	}
+}
+
+func TestDecodeSocketCANFrame(t *testing.T) {
+	c := newTestConverter(t, Option{Format: FormatSocketCAN})
+	// Speed = 12.3 km/h -> raw 123 (scale 0.1), little-endian in bytes 0-1
+	frame := buildCanFrame(100, []byte{123, 0})
+	decoded, err := c.Decode(frame)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	got := decoded.(map[string]interface{})
+	if got["Speed"] != 12.3 {
+		t.Errorf("expected Speed 12.3, got %v", got["Speed"])
+	}
+}
+
+// buildCanFDFrame renders a raw 72-byte struct canfd_frame carrying a
+// standard (11-bit) id and up to 64 data bytes.
+func buildCanFDFrame(id uint32, data []byte) []byte {
+	b := make([]byte, canFDFrameLen)
+	binary.LittleEndian.PutUint32(b[0:4], id)
+	b[4] = byte(len(data))
+	copy(b[8:], data)
+	return b
+}
+
+func TestDecodeSocketCANFDFrameBeyondEightBytes(t *testing.T) {
+	c := newTestConverter(t, Option{Format: FormatSocketCAN, FD: true})
+	// FdSignal lives at byte 8, past what a classic can.Frame's 8-byte Data
+	// could ever hold, so this only decodes correctly if the FD payload isn't
+	// truncated on the way in.
+	data := make([]byte, 10)
+	binary.LittleEndian.PutUint16(data[8:10], 4242)
+	frame := buildCanFDFrame(300, data)
+
+	decoded, err := c.Decode(frame)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	got := decoded.(map[string]interface{})
+	if got["FdSignal"] != 4242.0 {
+		t.Errorf("expected FdSignal 4242, got %v", got["FdSignal"])
+	}
+}
+
+func TestDecodeSocketCANFrameRejectsOversizedDlc(t *testing.T) {
+	c := newTestConverter(t, Option{Format: FormatSocketCAN})
+	frame := buildCanFrame(100, []byte{123, 0})
+	// claim more data than a classic can_frame can carry
+	frame[4] = 9
+	if _, err := c.Decode(frame); err == nil {
+		t.Fatalf("expected an error for a dlc beyond the frame's payload")
+	}
+}
+
+func TestDecodeSocketCANBatch(t *testing.T) {
+	c := newTestConverter(t, Option{Format: FormatSocketCAN, Batch: true})
+
+	record := func(ts int64, id uint32, data []byte) []byte {
+		b := make([]byte, timestampLen)
+		binary.LittleEndian.PutUint64(b, uint64(ts))
+		return append(b, buildCanFrame(id, data)...)
+	}
+	buf := append(record(1000, 100, []byte{100, 0}), record(2000, 100, []byte{200, 0})...)
+
+	decoded, err := c.Decode(buf)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	// signals land at the top level, matching decodeJSON and
+	// decodeSocketCANFrame's flat shape, with timestamps in a sibling meta key
+	out := decoded.(map[string]interface{})
+	meta := out["meta"].(map[string]interface{})
+	timestamps := meta["timestamps"].([]int64)
+	if !reflect.DeepEqual(timestamps, []int64{1000, 2000}) {
+		t.Errorf("expected timestamps [1000 2000], got %v", timestamps)
+	}
+	// the second frame's Speed overwrites the first in the merged map
+	if out["Speed"] != 20.0 {
+		t.Errorf("expected merged Speed 20.0, got %v", out["Speed"])
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2023 EMQ Technologies Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package can
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/ngjaying/can/pkg/descriptor"
+	"github.com/ngjaying/can/pkg/generate"
+
+	"github.com/lf-edge/ekuiper/internal/conf"
+)
+
+// dbcKey namespaces a loaded message by bus/channel so the same CAN id can
+// decode differently per source, e.g. two buses both using id 100 for
+// unrelated messages. bus is "" for DBC files placed directly under the
+// catalog root rather than in a per-bus subdirectory.
+type dbcKey struct {
+	bus string
+	id  uint32
+}
+
+// DBCCatalog loads every *.dbc file under a root path, namespaced by the
+// immediate subdirectory they live in (the "bus"), and keeps watching that
+// root for changes so it can be refreshed without restarting eKuiper.
+// Readers consult it through Lookup, which always reflects a single,
+// internally-consistent snapshot even while a reload is in progress.
+type DBCCatalog struct {
+	root     string
+	snapshot atomic.Pointer[map[dbcKey]*descriptor.Message]
+	watcher  *fsnotify.Watcher
+	done     chan struct{}
+}
+
+// NewDBCCatalog loads dbcPath (a single .dbc file or a directory tree of
+// them) and, if it is a directory, starts watching it for changes.
+func NewDBCCatalog(dbcPath string) (*DBCCatalog, error) {
+	info, err := os.Stat(dbcPath)
+	if err != nil {
+		return nil, err
+	}
+	cat := &DBCCatalog{root: dbcPath, done: make(chan struct{})}
+	if err := cat.reload(); err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		if err := cat.startWatching(); err != nil {
+			// hot-reload is a convenience; fall back to the one-time load
+			// rather than failing catalog construction over it
+			conf.Log.Errorf("cannot watch dbc directory %s for changes: %v", dbcPath, err)
+		}
+	}
+	return cat, nil
+}
+
+// Lookup returns the message describing id on bus, consulting a single
+// atomic snapshot so concurrent decodes are never torn by a reload.
+func (cat *DBCCatalog) Lookup(bus string, id uint32) (*descriptor.Message, bool) {
+	mm := cat.snapshot.Load()
+	if mm == nil {
+		return nil, false
+	}
+	m, ok := (*mm)[dbcKey{bus: bus, id: id}]
+	return m, ok
+}
+
+// Close stops the background watcher, if any. Safe to call more than once.
+func (cat *DBCCatalog) Close() error {
+	if cat.watcher == nil {
+		return nil
+	}
+	select {
+	case <-cat.done:
+		return nil
+	default:
+		close(cat.done)
+	}
+	return cat.watcher.Close()
+}
+
+func (cat *DBCCatalog) reload() error {
+	mm, err := loadDBCDir(cat.root)
+	if err != nil {
+		return err
+	}
+	cat.snapshot.Store(&mm)
+	return nil
+}
+
+func (cat *DBCCatalog) startWatching() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(cat.root); err != nil {
+		w.Close()
+		return err
+	}
+	// bus subdirectories get their own watch so renames/creates inside them
+	// are also observed; this is one level deep, matching the bus namespacing
+	// rule in loadDBCDir.
+	entries, err := os.ReadDir(cat.root)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			if err := w.Add(filepath.Join(cat.root, e.Name())); err != nil {
+				conf.Log.Errorf("cannot watch dbc bus directory %s: %v", e.Name(), err)
+			}
+		}
+	}
+	cat.watcher = w
+	go cat.watchLoop()
+	return nil
+}
+
+func (cat *DBCCatalog) watchLoop() {
+	for {
+		select {
+		case <-cat.done:
+			return
+		case event, ok := <-cat.watcher.Events:
+			if !ok {
+				return
+			}
+			// a newly-created bus subdirectory needs its own watch before any
+			// .dbc file dropped into it can ever be seen; do this before the
+			// extension filter below, since the directory's own Create event
+			// never matches ".dbc". Reload right away too: a .dbc file can
+			// race ahead of this watch and land inside the directory before
+			// Add returns, and that file's own Create event would otherwise
+			// never be observed.
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := cat.watcher.Add(event.Name); err != nil {
+						conf.Log.Errorf("cannot watch new dbc bus directory %s: %v", event.Name, err)
+					}
+					if err := cat.reload(); err != nil {
+						conf.Log.Errorf("cannot reload dbc catalog %s after %s: %v", cat.root, event, err)
+					}
+					continue
+				}
+			}
+			if !strings.EqualFold(filepath.Ext(event.Name), ".dbc") {
+				continue
+			}
+			if err := cat.reload(); err != nil {
+				conf.Log.Errorf("cannot reload dbc catalog %s after %s: %v", cat.root, event, err)
+			}
+		case err, ok := <-cat.watcher.Errors:
+			if !ok {
+				return
+			}
+			conf.Log.Errorf("dbc catalog watcher for %s reported an error: %v", cat.root, err)
+		}
+	}
+}
+
+// loadDBCDir reads dbcPath -- a single .dbc file, or a directory of them,
+// optionally one level of bus subdirectories deep -- into a fresh
+// (bus, id) -> message map. Each file is read with its own os.ReadFile
+// instead of sharing one buffer sized for the largest file, so loading one
+// file can never truncate another's content. A CAN id redefined within the
+// same bus is kept as the first definition seen and reported through
+// conf.Log with both filenames rather than silently dropped.
+func loadDBCDir(dbcPath string) (map[dbcKey]*descriptor.Message, error) {
+	info, err := os.Stat(dbcPath)
+	if err != nil {
+		return nil, err
+	}
+	mm := make(map[dbcKey]*descriptor.Message)
+	if !info.IsDir() {
+		dbc, err := os.ReadFile(dbcPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := addMessageDb(mm, make(map[dbcKey]string), "", dbcPath, dbc); err != nil {
+			return nil, err
+		}
+		return mm, nil
+	}
+
+	sources := make(map[dbcKey]string)
+	err = filepath.Walk(dbcPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			// bus subdirectories are one level deep; deeper trees are not loaded
+			if rel, err := filepath.Rel(dbcPath, path); err == nil && strings.Contains(filepath.ToSlash(rel), "/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.EqualFold(filepath.Ext(path), ".dbc") {
+			return nil
+		}
+		bus := busOf(dbcPath, path)
+		dbc, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return addMessageDb(mm, sources, bus, path, dbc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mm, nil
+}
+
+// busOf derives the bus namespace for a DBC file from its position under
+// root: files directly in root decode on the default ("") bus; files one
+// directory down decode on the bus named after that directory.
+func busOf(root, path string) string {
+	rel, err := filepath.Rel(root, filepath.Dir(path))
+	if err != nil || rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+func addMessageDb(mm map[dbcKey]*descriptor.Message, sources map[dbcKey]string, bus, dbcPath string, dbcContent []byte) error {
+	c, err := generate.Compile(dbcPath, dbcContent)
+	if err != nil {
+		return err
+	}
+	for _, m := range c.Database.Messages {
+		key := dbcKey{bus: bus, id: m.ID}
+		if existing, ok := sources[key]; ok {
+			conf.Log.Errorf("dbc message id %d on bus %q already loaded from %s, ignoring redefinition in %s", m.ID, bus, existing, dbcPath)
+			continue
+		}
+		mm[key] = m
+		sources[key] = dbcPath
+	}
+	return nil
+}
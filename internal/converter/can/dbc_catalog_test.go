@@ -0,0 +1,133 @@
+// Copyright 2023 EMQ Technologies Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package can
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const busADbc = `VERSION ""
+
+NS_ :
+
+BS_:
+
+BU_: ECU
+
+BO_ 100 BUS_A_MSG: 8 ECU
+ SG_ BusASignal : 0|16@1+ (1,0) [0|65535] "" ECU
+`
+
+const busBDbc = `VERSION ""
+
+NS_ :
+
+BS_:
+
+BU_: ECU
+
+BO_ 100 BUS_B_MSG: 8 ECU
+ SG_ BusBSignal : 0|16@1+ (1,0) [0|65535] "" ECU
+`
+
+func TestDBCCatalogNamespacesByBus(t *testing.T) {
+	root := t.TempDir()
+	for _, sub := range []string{"can0", "can1"} {
+		if err := os.MkdirAll(filepath.Join(root, sub), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "can0", "a.dbc"), []byte(busADbc), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "can1", "b.dbc"), []byte(busBDbc), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	cat, err := NewDBCCatalog(root)
+	if err != nil {
+		t.Fatalf("NewDBCCatalog: %v", err)
+	}
+	defer cat.Close()
+
+	a, ok := cat.Lookup("can0", 100)
+	if !ok || a.Name != "BUS_A_MSG" {
+		t.Fatalf("expected BUS_A_MSG on can0, got %v, ok=%v", a, ok)
+	}
+	b, ok := cat.Lookup("can1", 100)
+	if !ok || b.Name != "BUS_B_MSG" {
+		t.Fatalf("expected BUS_B_MSG on can1, got %v, ok=%v", b, ok)
+	}
+	if _, ok := cat.Lookup("can0", 999); ok {
+		t.Errorf("expected no message for unknown id 999")
+	}
+}
+
+func TestDBCCatalogHotReload(t *testing.T) {
+	root := t.TempDir()
+	cat, err := NewDBCCatalog(root)
+	if err != nil {
+		t.Fatalf("NewDBCCatalog: %v", err)
+	}
+	defer cat.Close()
+
+	if _, ok := cat.Lookup("", 100); ok {
+		t.Fatalf("expected no messages before any dbc file is added")
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "live.dbc"), []byte(busADbc), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := cat.Lookup("", 100); ok {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("catalog did not pick up the new dbc file within the deadline")
+}
+
+func TestDBCCatalogHotReloadNewBusDirectory(t *testing.T) {
+	root := t.TempDir()
+	cat, err := NewDBCCatalog(root)
+	if err != nil {
+		t.Fatalf("NewDBCCatalog: %v", err)
+	}
+	defer cat.Close()
+
+	// can0 did not exist when the catalog was constructed, so this exercises
+	// the watcher picking up a brand new bus subdirectory, not just new files
+	// in directories it already knew about.
+	if err := os.MkdirAll(filepath.Join(root, "can0"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "can0", "a.dbc"), []byte(busADbc), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := cat.Lookup("can0", 100); ok {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("catalog did not pick up the new bus directory within the deadline")
+}
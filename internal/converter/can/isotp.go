@@ -0,0 +1,200 @@
+// Copyright 2023 EMQ Technologies Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package can
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ISO-TP (ISO 15765-2) protocol control information nibble values, carried in
+// the high nibble of the first payload byte.
+const (
+	isotpSingleFrame       byte = 0x0
+	isotpFirstFrame        byte = 0x1
+	isotpConsecutiveFrame  byte = 0x2
+	isotpFlowControl       byte = 0x3
+	isotpSeqMask           byte = 0x0F
+	isotpFirstFrameLenMask byte = 0x0F
+)
+
+// IsoTPConfig bounds the behavior and memory usage of an isoTPReassembler.
+type IsoTPConfig struct {
+	// STmin is the minimum separation time between consecutive frames this
+	// converter would request of a peer. It is not enforced on the receive
+	// path (reassembly accepts CFs as they arrive); it exists so a future
+	// outbound flow-control responder can advertise it.
+	STmin time.Duration
+	// BlockSize is the number of consecutive frames a peer may send before
+	// waiting for another flow-control frame. Like STmin it is currently only
+	// relevant once outbound flow control is implemented.
+	BlockSize uint8
+	// ConsecutiveTimeout is how long a session may wait for its next
+	// consecutive frame before being evicted. Zero disables the timeout.
+	ConsecutiveTimeout time.Duration
+	// MaxSessions caps the number of concurrently in-flight reassembly
+	// sessions, bounding memory when many ids are multiplexed.
+	MaxSessions int
+	// AddressingExtension treats the first byte of every frame as an ISO-TP
+	// addressing-extension byte (normal/mixed addressing) rather than part of
+	// the PCI, so sessions are additionally keyed by it.
+	AddressingExtension bool
+}
+
+// DefaultIsoTPConfig returns reasonable defaults: a 1ms STmin, a block size of
+// 8, a 1s consecutive-frame timeout and at most 256 concurrent sessions.
+func DefaultIsoTPConfig() IsoTPConfig {
+	return IsoTPConfig{
+		STmin:              time.Millisecond,
+		BlockSize:          8,
+		ConsecutiveTimeout: time.Second,
+		MaxSessions:        256,
+	}
+}
+
+type isoTPKey struct {
+	bus   string
+	id    uint32
+	ae    byte
+	hasAE bool
+}
+
+type isoTPSession struct {
+	buf      []byte
+	want     int
+	nextSeq  byte
+	lastSeen time.Time
+}
+
+// isoTPReassembler reassembles ISO-TP single/first/consecutive frames into
+// complete payloads, keyed per source bus and CAN id (and, optionally,
+// addressing extension byte), so two buses that happen to reuse the same id
+// never share an in-flight session. It is safe for concurrent use.
+type isoTPReassembler struct {
+	cfg      IsoTPConfig
+	mu       sync.Mutex
+	sessions map[isoTPKey]*isoTPSession
+}
+
+func newIsoTPReassembler(cfg IsoTPConfig) *isoTPReassembler {
+	return &isoTPReassembler{
+		cfg:      cfg,
+		sessions: make(map[isoTPKey]*isoTPSession),
+	}
+}
+
+// feed processes one CAN frame's payload for id on bus and returns the
+// reassembled payload once complete. A nil, nil result means the frame was
+// consumed but no payload is complete yet (e.g. a first or consecutive frame
+// still waiting on more data, or an inbound flow-control frame).
+func (r *isoTPReassembler) feed(bus string, id uint32, data []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.evictLocked()
+
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty ISO-TP frame for id %d on bus %q", id, bus)
+	}
+	key := isoTPKey{bus: bus, id: id}
+	payload := data
+	if r.cfg.AddressingExtension {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("ISO-TP frame for id %d too short to carry an addressing extension byte", id)
+		}
+		key.ae, key.hasAE = data[0], true
+		payload = data[1:]
+	}
+
+	switch pci := payload[0] >> 4; pci {
+	case isotpSingleFrame:
+		length := int(payload[0] & isotpFirstFrameLenMask)
+		if length == 0 || len(payload) < 1+length {
+			return nil, fmt.Errorf("invalid ISO-TP single frame for id %d: declared length %d, have %d payload bytes", id, length, len(payload)-1)
+		}
+		// a new SF aborts any session already in flight for this key
+		delete(r.sessions, key)
+		out := make([]byte, length)
+		copy(out, payload[1:1+length])
+		return out, nil
+
+	case isotpFirstFrame:
+		if len(payload) < 2 {
+			return nil, fmt.Errorf("ISO-TP first frame for id %d too short", id)
+		}
+		length := int(payload[0]&isotpFirstFrameLenMask)<<8 | int(payload[1])
+		if length <= len(payload)-2 {
+			return nil, fmt.Errorf("ISO-TP first frame for id %d declares length %d not larger than its own data", id, length)
+		}
+		if _, exists := r.sessions[key]; !exists && r.cfg.MaxSessions > 0 && len(r.sessions) >= r.cfg.MaxSessions {
+			return nil, fmt.Errorf("ISO-TP session cap (%d) reached, dropping first frame for id %d", r.cfg.MaxSessions, id)
+		}
+		sess := &isoTPSession{
+			buf:      append([]byte(nil), payload[2:]...),
+			want:     length,
+			nextSeq:  1,
+			lastSeen: time.Now(),
+		}
+		r.sessions[key] = sess
+		return nil, nil
+
+	case isotpConsecutiveFrame:
+		sess, ok := r.sessions[key]
+		if !ok {
+			return nil, fmt.Errorf("consecutive frame for id %d with no active first frame, dropped", id)
+		}
+		seq := payload[0] & isotpSeqMask
+		if seq != sess.nextSeq {
+			delete(r.sessions, key)
+			return nil, fmt.Errorf("out-of-order consecutive frame for id %d: expected seq %d, got %d", id, sess.nextSeq, seq)
+		}
+		remaining := sess.want - len(sess.buf)
+		chunk := payload[1:]
+		if len(chunk) > remaining {
+			chunk = chunk[:remaining]
+		}
+		sess.buf = append(sess.buf, chunk...)
+		sess.nextSeq = (seq + 1) & isotpSeqMask
+		sess.lastSeen = time.Now()
+		if len(sess.buf) >= sess.want {
+			delete(r.sessions, key)
+			return sess.buf[:sess.want], nil
+		}
+		return nil, nil
+
+	case isotpFlowControl:
+		// Flow control is treated as outbound only for now: this converter
+		// does not yet pace its own consecutive frames against a peer's FC,
+		// so an inbound FC carries no reassembly state to update.
+		return nil, nil
+
+	default:
+		return nil, fmt.Errorf("unknown ISO-TP PCI type %d for id %d", pci, id)
+	}
+}
+
+// evictLocked drops sessions that have been waiting longer than
+// ConsecutiveTimeout. Called with mu held.
+func (r *isoTPReassembler) evictLocked() {
+	if r.cfg.ConsecutiveTimeout <= 0 {
+		return
+	}
+	now := time.Now()
+	for k, s := range r.sessions {
+		if now.Sub(s.lastSeen) > r.cfg.ConsecutiveTimeout {
+			delete(r.sessions, k)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2023 EMQ Technologies Co., Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package can
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestIsoTPSingleFrame(t *testing.T) {
+	r := newIsoTPReassembler(DefaultIsoTPConfig())
+	payload, err := r.feed("", 0x700, []byte{0x04, 0xDE, 0xAD, 0xBE, 0xEF, 0, 0, 0})
+	if err != nil {
+		t.Fatalf("feed: %v", err)
+	}
+	if !bytes.Equal(payload, []byte{0xDE, 0xAD, 0xBE, 0xEF}) {
+		t.Errorf("unexpected payload %x", payload)
+	}
+}
+
+func TestIsoTPFirstAndConsecutiveFrames(t *testing.T) {
+	r := newIsoTPReassembler(DefaultIsoTPConfig())
+
+	// FF declares a 10-byte payload, carries the first 6
+	payload, err := r.feed("", 0x700, []byte{0x10, 0x0A, 1, 2, 3, 4, 5, 6})
+	if err != nil {
+		t.Fatalf("feed FF: %v", err)
+	}
+	if payload != nil {
+		t.Fatalf("expected no payload yet, got %x", payload)
+	}
+
+	// CF seq 1 carries the remaining 4 bytes
+	payload, err = r.feed("", 0x700, []byte{0x21, 7, 8, 9, 10, 0, 0, 0})
+	if err != nil {
+		t.Fatalf("feed CF: %v", err)
+	}
+	want := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	if !bytes.Equal(payload, want) {
+		t.Errorf("reassembled payload = %x, want %x", payload, want)
+	}
+}
+
+func TestIsoTPSequenceWrapAt0xF(t *testing.T) {
+	r := newIsoTPReassembler(DefaultIsoTPConfig())
+	// 6 bytes in the FF plus 16 CFs of 7 bytes each pushes the sequence
+	// counter through its full 1..0xF,0x0 cycle.
+	const ffBytes = 6
+	const cfCount = 16
+	length := ffBytes + cfCount*7
+
+	want := []byte{1, 2, 3, 4, 5, 6}
+	ffHdr := []byte{0x10 | byte(length>>8), byte(length)}
+	if _, err := r.feed("", 0x700, append(ffHdr, want...)); err != nil {
+		t.Fatalf("feed FF: %v", err)
+	}
+
+	var payload []byte
+	next := byte(7)
+	for seq := 1; seq <= cfCount; seq++ {
+		chunk := make([]byte, 7)
+		for i := range chunk {
+			chunk[i] = next
+			next++
+		}
+		want = append(want, chunk...)
+		var err error
+		payload, err = r.feed("", 0x700, append([]byte{0x20 | byte(seq&0x0F)}, chunk...))
+		if err != nil {
+			t.Fatalf("feed CF seq %d (nibble %x): %v", seq, seq&0x0F, err)
+		}
+		if seq < cfCount && payload != nil {
+			t.Fatalf("unexpected early completion at seq %d: %x", seq, payload)
+		}
+	}
+	if !bytes.Equal(payload, want) {
+		t.Errorf("final payload = %x, want %x", payload, want)
+	}
+}
+
+func TestIsoTPOutOfOrderConsecutiveFrameDropsSession(t *testing.T) {
+	r := newIsoTPReassembler(DefaultIsoTPConfig())
+	if _, err := r.feed("", 0x700, []byte{0x10, 0x0A, 1, 2, 3, 4, 5, 6}); err != nil {
+		t.Fatalf("feed FF: %v", err)
+	}
+	// send seq 2 instead of the expected seq 1
+	if _, err := r.feed("", 0x700, []byte{0x22, 7, 8, 9, 10, 0, 0, 0}); err == nil {
+		t.Fatalf("expected an error for an out-of-order consecutive frame")
+	}
+	if len(r.sessions) != 0 {
+		t.Errorf("expected session to be dropped after out-of-order CF, still have %d", len(r.sessions))
+	}
+}
+
+func TestIsoTPConsecutiveFrameTimeoutEviction(t *testing.T) {
+	cfg := DefaultIsoTPConfig()
+	cfg.ConsecutiveTimeout = time.Millisecond
+	r := newIsoTPReassembler(cfg)
+	if _, err := r.feed("", 0x700, []byte{0x10, 0x0A, 1, 2, 3, 4, 5, 6}); err != nil {
+		t.Fatalf("feed FF: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	// the stale session should be evicted before this CF is matched, so it
+	// is treated as an orphan consecutive frame rather than completing
+	if _, err := r.feed("", 0x700, []byte{0x21, 7, 8, 9, 10, 0, 0, 0}); err == nil {
+		t.Fatalf("expected stale session to have been evicted")
+	}
+}
+
+func TestIsoTPSessionCap(t *testing.T) {
+	cfg := DefaultIsoTPConfig()
+	cfg.MaxSessions = 1
+	r := newIsoTPReassembler(cfg)
+	if _, err := r.feed("", 0x700, []byte{0x10, 0x0A, 1, 2, 3, 4, 5, 6}); err != nil {
+		t.Fatalf("feed FF for id 0x700: %v", err)
+	}
+	if _, err := r.feed("", 0x701, []byte{0x10, 0x0A, 1, 2, 3, 4, 5, 6}); err == nil {
+		t.Fatalf("expected session cap to reject a second in-flight id")
+	}
+}
+
+func TestIsoTPSameIdDifferentBusesDoNotShareASession(t *testing.T) {
+	r := newIsoTPReassembler(DefaultIsoTPConfig())
+	// start a first frame for id 0x700 on each of two buses
+	if _, err := r.feed("can0", 0x700, []byte{0x10, 0x0A, 1, 2, 3, 4, 5, 6}); err != nil {
+		t.Fatalf("feed FF on can0: %v", err)
+	}
+	if _, err := r.feed("can1", 0x700, []byte{0x10, 0x0A, 9, 8, 7, 6, 5, 4}); err != nil {
+		t.Fatalf("feed FF on can1: %v", err)
+	}
+
+	// completing can1's session must not disturb can0's in-flight one
+	payload, err := r.feed("can1", 0x700, []byte{0x21, 3, 2, 1, 0, 0, 0, 0})
+	if err != nil {
+		t.Fatalf("feed CF on can1: %v", err)
+	}
+	if want := []byte{9, 8, 7, 6, 5, 4, 3, 2, 1, 0}; !bytes.Equal(payload, want) {
+		t.Errorf("can1 payload = %x, want %x", payload, want)
+	}
+
+	payload, err = r.feed("can0", 0x700, []byte{0x21, 7, 8, 9, 10, 0, 0, 0})
+	if err != nil {
+		t.Fatalf("feed CF on can0: %v", err)
+	}
+	if want := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}; !bytes.Equal(payload, want) {
+		t.Errorf("can0 payload = %x, want %x (bus isolation broken)", payload, want)
+	}
+}